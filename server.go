@@ -0,0 +1,324 @@
+package socks4
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	typedErrors "github.com/Bogdan-D/go-typed-errors"
+	"golang.org/x/net/proxy"
+)
+
+// maxFieldLen bounds the USERID and (for socks4a) hostname fields read from
+// an inbound request. Without a cap, a client that never sends the NUL
+// terminator would pin a goroutine and grow an unbounded buffer regardless
+// of whether the operator set ReadTimeout.
+const maxFieldLen = 255
+
+// ErrRequestFieldTooLong is returned when a USERID or hostname field runs
+// past maxFieldLen without a NUL terminator.
+var ErrRequestFieldTooLong = typedErrors.String("socks4 request field exceeds %d bytes")
+
+// ErrInvalidRequest is returned when an inbound request's version byte is
+// not SOCKS4.
+var ErrInvalidRequest = typedErrors.String("unknown socks4 request version %v")
+
+// Server implements a SOCKS4/4a inbound proxy: it accepts CONNECT (and,
+// optionally, BIND) requests. CONNECT destinations are reached through
+// Dialer; BIND listens on a local port directly, without Dialer.
+type Server struct {
+	// Dialer reaches the destination requested by the client. Defaults to
+	// proxy.Direct when nil.
+	Dialer proxy.Dialer
+
+	// Authenticate validates the USERID sent in the request. A nil
+	// Authenticate accepts every ident.
+	Authenticate func(ident string, srcAddr net.Addr) error
+
+	// Logger receives diagnostics about rejected or failed requests. A nil
+	// Logger discards them.
+	Logger *log.Logger
+
+	// EnableBind allows clients to issue BIND (0x02) requests. It is off by
+	// default since a BIND listener on a proxy-chosen port is rarely
+	// something a server operator wants exposed unconditionally.
+	EnableBind bool
+
+	// ReadTimeout bounds the handshake read and, for BIND, the wait for the
+	// remote peer to connect back. WriteTimeout bounds each reply write.
+	// Zero means no deadline.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+// request is the parsed form of an inbound SOCKS4/4a request.
+type request struct {
+	command byte
+	ident   string
+	host    string
+	port    uint16
+}
+
+// ListenAndServe listens on addr and calls Serve to handle incoming
+// connections.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l, handling each one in its own goroutine,
+// until Accept returns an error.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	if s.ReadTimeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+	}
+
+	br := bufio.NewReader(conn)
+
+	req, err := s.readRequest(br)
+	if err != nil {
+		s.logf("socks4: %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	if s.Authenticate != nil {
+		if err := s.Authenticate(req.ident, conn.RemoteAddr()); err != nil {
+			s.logf("socks4: %s: ident %q rejected: %v", conn.RemoteAddr(), req.ident, err)
+			_ = s.reply(conn, accessIdentFailed, nil)
+			return
+		}
+	}
+
+	switch req.command {
+	case socksConnect:
+		s.handleConnect(conn, br, req)
+	case socksBind:
+		if !s.EnableBind {
+			s.logf("socks4: %s: BIND is disabled", conn.RemoteAddr())
+			_ = s.reply(conn, accessRejected, nil)
+			return
+		}
+		s.handleBind(conn, br, req)
+	default:
+		s.logf("socks4: %s: unsupported command %#x", conn.RemoteAddr(), req.command)
+		_ = s.reply(conn, accessRejected, nil)
+	}
+}
+
+// readRequest parses the 8-byte header, the null-terminated USERID and, for
+// socks4a's 0.0.0.x sentinel, the trailing hostname.
+func (s *Server) readRequest(br *bufio.Reader) (*request, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, ErrIO.Wrap(err)
+	}
+
+	if hdr[0] != socksVersion {
+		return nil, ErrInvalidRequest.WithArgs(hdr[0])
+	}
+
+	ident, err := readCString(br, maxFieldLen)
+	if err != nil {
+		return nil, err
+	}
+
+	host := net.IPv4(hdr[4], hdr[5], hdr[6], hdr[7]).String()
+
+	// socks4a defines IP as 0.0.0.x, with a null-terminated hostname
+	// following the USERID.
+	if hdr[4] == 0 && hdr[5] == 0 && hdr[6] == 0 && hdr[7] != 0 {
+		host, err = readCString(br, maxFieldLen)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &request{
+		command: hdr[1],
+		ident:   ident,
+		host:    host,
+		port:    binary.BigEndian.Uint16(hdr[2:4]),
+	}, nil
+}
+
+// readCString reads a NUL-terminated field, without the trailing NUL,
+// refusing to buffer more than max bytes.
+func readCString(br *bufio.Reader, max int) (string, error) {
+	buf := make([]byte, 0, 32)
+
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return "", ErrIO.Wrap(err)
+		}
+
+		if b == 0 {
+			return string(buf), nil
+		}
+
+		if len(buf) >= max {
+			return "", ErrRequestFieldTooLong.WithArgs(max)
+		}
+
+		buf = append(buf, b)
+	}
+}
+
+func (s *Server) reply(conn net.Conn, code byte, addr net.Addr) error {
+	if s.WriteTimeout > 0 {
+		_ = conn.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+	}
+
+	resp := [8]byte{0x00, code}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		binary.BigEndian.PutUint16(resp[2:4], uint16(tcpAddr.Port))
+		copy(resp[4:8], tcpAddr.IP.To4())
+	}
+
+	_, err := conn.Write(resp[:])
+	return err
+}
+
+func (s *Server) handleConnect(conn net.Conn, br *bufio.Reader, req *request) {
+	dst, err := s.dialer().Dial("tcp", net.JoinHostPort(req.host, strconv.Itoa(int(req.port))))
+	if err != nil {
+		s.logf("socks4: %s: dial %s:%d failed: %v", conn.RemoteAddr(), req.host, req.port, err)
+		_ = s.reply(conn, accessRejected, nil)
+		return
+	}
+	defer dst.Close()
+
+	if err := s.reply(conn, accessGranted, dst.LocalAddr()); err != nil {
+		return
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	proxyData(conn, br, dst)
+}
+
+// handleBind implements the BIND command: it opens a listener, reports its
+// address back to the client so it can be handed to a remote peer, then
+// waits for that peer to connect before reporting it in a second reply and
+// starting to proxy data.
+func (s *Server) handleBind(conn net.Conn, br *bufio.Reader, req *request) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		s.logf("socks4: %s: bind listen failed: %v", conn.RemoteAddr(), err)
+		_ = s.reply(conn, accessRejected, nil)
+		return
+	}
+	defer ln.Close()
+
+	if err := s.reply(conn, accessGranted, externalBindAddr(conn, ln)); err != nil {
+		return
+	}
+
+	ctx := context.Background()
+	if s.ReadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.ReadTimeout)
+		defer cancel()
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		peer, err := ln.Accept()
+		if err == nil {
+			accepted <- peer
+		}
+	}()
+
+	var peer net.Conn
+	select {
+	case peer = <-accepted:
+	case <-ctx.Done():
+		s.logf("socks4: %s: bind: %v", conn.RemoteAddr(), ctx.Err())
+		_ = s.reply(conn, accessRejected, nil)
+		return
+	}
+	defer peer.Close()
+
+	if err := s.reply(conn, accessGranted, peer.RemoteAddr()); err != nil {
+		return
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	proxyData(conn, br, peer)
+}
+
+// externalBindAddr reports ln's port on the address the client already
+// reached this server on. ln.Addr() alone is the wildcard 0.0.0.0 address
+// net.Listen("tcp", ":0") binds to, which a real remote peer can't dial
+// back to - only same-host testing "works" because the OS special-cases
+// dialing 0.0.0.0 as localhost.
+func externalBindAddr(conn net.Conn, ln net.Listener) net.Addr {
+	lnAddr, ok := ln.Addr().(*net.TCPAddr)
+	if !ok {
+		return ln.Addr()
+	}
+
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return lnAddr
+	}
+
+	return &net.TCPAddr{IP: local.IP, Port: lnAddr.Port}
+}
+
+func (s *Server) dialer() proxy.Dialer {
+	if s.Dialer != nil {
+		return s.Dialer
+	}
+
+	return proxy.Direct
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, args...)
+	}
+}
+
+// proxyData copies bytes in both directions between conn and dst until one
+// side closes, then waits for both copies to finish. Reads from conn go
+// through br rather than conn directly, since br may already hold bytes the
+// client pushed past the end of the handshake.
+func proxyData(conn net.Conn, br *bufio.Reader, dst net.Conn) {
+	done := make(chan struct{}, 2)
+
+	go func() {
+		_, _ = io.Copy(dst, br)
+		_ = dst.Close()
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(conn, dst)
+		_ = conn.Close()
+		done <- struct{}{}
+	}()
+
+	<-done
+	<-done
+}
@@ -0,0 +1,223 @@
+package socks4
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func startEchoServer(t *testing.T) net.Listener {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(c net.Conn) {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}(conn)
+		}
+	}()
+
+	return ln
+}
+
+func startProxy(t *testing.T, srv *Server) net.Listener {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	go func() { _ = srv.Serve(ln) }()
+
+	return ln
+}
+
+func dialThroughProxy(t *testing.T, proxyAddr string) *Dialer {
+	t.Helper()
+
+	d, err := NewDialer(&url.URL{Scheme: "socks4", Host: proxyAddr}, nil)
+	if err != nil {
+		t.Fatalf("NewDialer: %v", err)
+	}
+
+	return d.(*Dialer)
+}
+
+// TestServerConnect exercises a full client/server SOCKS4 CONNECT round
+// trip: Dialer.Dial through a Server, which forwards to a real destination.
+func TestServerConnect(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	proxy := startProxy(t, &Server{})
+	defer proxy.Close()
+
+	d := dialThroughProxy(t, proxy.Addr().String())
+
+	conn, err := d.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("got %q, want %q", buf, "ping")
+	}
+}
+
+// TestServerConnectPipelinedPayload covers a client that doesn't pace its
+// writes to stay behind the server's handshake read boundary, instead
+// pushing the request and the first chunk of payload in a single Write.
+// That payload must still reach the destination instead of being stranded
+// in the server's internal bufio.Reader.
+func TestServerConnectPipelinedPayload(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	proxy := startProxy(t, &Server{})
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+
+	req := connectRequest(t, echo.Addr().(*net.TCPAddr))
+	if _, err := conn.Write(append(req, []byte("PAYLOAD")...)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	var resp [8]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if resp[1] != accessGranted {
+		t.Fatalf("reply code = %#x, want accessGranted", resp[1])
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, len("PAYLOAD"))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read echoed payload: %v", err)
+	}
+	if string(buf) != "PAYLOAD" {
+		t.Fatalf("got %q, want %q", buf, "PAYLOAD")
+	}
+}
+
+// connectRequest builds a raw SOCKS4 CONNECT request for dst.
+func connectRequest(t *testing.T, dst *net.TCPAddr) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	buf.WriteByte(socksVersion)
+	buf.WriteByte(socksConnect)
+	_ = binary.Write(&buf, binary.BigEndian, uint16(dst.Port))
+	buf.Write(dst.IP.To4())
+	buf.WriteString("tester")
+	buf.WriteByte(0)
+
+	return buf.Bytes()
+}
+
+// TestServerBind exercises a full BIND round trip through Dialer.Listen and,
+// crucially, checks that the advertised bind address is the server's
+// externally-reachable address rather than the listener's wildcard
+// 0.0.0.0 - a remote peer dialing 0.0.0.0 back only "works" on the same
+// host.
+func TestServerBind(t *testing.T) {
+	proxy := startProxy(t, &Server{EnableBind: true, ReadTimeout: 2 * time.Second})
+	defer proxy.Close()
+
+	d := dialThroughProxy(t, proxy.Addr().String())
+
+	ln, err := d.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	bindAddr, ok := ln.Addr().(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("Addr() = %T, want *net.TCPAddr", ln.Addr())
+	}
+	if bindAddr.IP.IsUnspecified() {
+		t.Fatalf("bind address %v is unspecified; a real remote peer can't dial that back", bindAddr)
+	}
+
+	type acceptResult struct {
+		conn net.Conn
+		err  error
+	}
+	accepted := make(chan acceptResult, 1)
+	go func() {
+		conn, err := ln.Accept()
+		accepted <- acceptResult{conn, err}
+	}()
+
+	peer, err := net.Dial("tcp", bindAddr.String())
+	if err != nil {
+		t.Fatalf("peer dial: %v", err)
+	}
+	defer peer.Close()
+
+	var proxyConn net.Conn
+	select {
+	case r := <-accepted:
+		if r.err != nil {
+			t.Fatalf("Accept: %v", r.err)
+		}
+		proxyConn = r.conn
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for Accept")
+	}
+	defer proxyConn.Close()
+
+	if _, err := peer.Write([]byte("hello")); err != nil {
+		t.Fatalf("peer write: %v", err)
+	}
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(proxyConn, buf); err != nil {
+		t.Fatalf("proxyConn read: %v", err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("got %q, want %q", buf, "hello")
+	}
+}
+
+// TestReadCStringBound ensures a field without a NUL terminator is rejected
+// rather than buffered without limit.
+func TestReadCStringBound(t *testing.T) {
+	oversized := append(bytes.Repeat([]byte{'a'}, maxFieldLen+1), 0)
+
+	if _, err := readCString(bufio.NewReader(bytes.NewReader(oversized)), maxFieldLen); err == nil {
+		t.Fatal("readCString accepted a field past maxFieldLen, want an error")
+	}
+}
@@ -4,11 +4,13 @@ package socks4 // import _ "github.com/Bogdan-D/go-socks4"
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"io"
 	"net"
 	"net/url"
 	"strconv"
+	"time"
 
 	typedErrors "github.com/Bogdan-D/go-typed-errors"
 	"golang.org/x/net/proxy"
@@ -17,8 +19,7 @@ import (
 const (
 	socksVersion = 0x04
 	socksConnect = 0x01
-	// nolint
-	socksBind = 0x02
+	socksBind    = 0x02
 
 	accessGranted       = 0x5a
 	accessRejected      = 0x5b
@@ -39,30 +40,135 @@ const (
 	ErrInvalidResponse = typedErrors.String("unknown socks4 server response %v")      // proxy reply contains invalid data
 )
 
+// Ident is sent as the USERID field of every request issued by dialers that
+// don't carry their own ident, either because they predate NewDialer or
+// because KeepGlobalIdent is set.
 var Ident = "nobody@0.0.0.0"
 
 func init() {
-	proxy.RegisterDialerType("socks4", func(u *url.URL, d proxy.Dialer) (proxy.Dialer, error) {
-		return socks4{url: u, dialer: d}, nil
-	})
+	register := func(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+		return NewDialer(u, forward)
+	}
 
-	proxy.RegisterDialerType("socks4a", func(u *url.URL, d proxy.Dialer) (proxy.Dialer, error) {
-		return socks4{url: u, dialer: d}, nil
-	})
+	proxy.RegisterDialerType("socks4", register)
+	proxy.RegisterDialerType("socks4a", register)
 }
 
-type socks4 struct {
-	url    *url.URL
-	dialer proxy.Dialer
+// Dialer implements proxy.Dialer, issuing a SOCKS4 or SOCKS4a handshake
+// over a connection obtained from a forwarding dialer before handing the
+// connection back to the caller.
+type Dialer struct {
+	// Ident is sent as the USERID field of every request, once set either
+	// by NewDialer from the dial URL's userinfo or by WithIdent - including
+	// WithIdent(""), which sends a genuinely empty USERID. Until then, the
+	// Dialer keeps reading the package-level Ident var live on every dial,
+	// the same as the pre-NewDialer behavior.
+	Ident string
+
+	// Resolver resolves socks4 (non-socks4a) destination hosts to an IPv4
+	// address. Defaults to net.DefaultResolver.
+	Resolver *net.Resolver
+
+	// Timeout bounds the SOCKS4 handshake of Dial and DialContext. Zero means
+	// no timeout. Listen's BIND handshake is not bounded by it.
+	Timeout time.Duration
+
+	// KeepGlobalIdent makes the Dialer ignore both its own Ident field and
+	// any userinfo on the dial URL, always sending the package-level Ident
+	// var instead. It exists for callers that relied on that process-wide
+	// behavior before NewDialer could hand out per-instance idents.
+	KeepGlobalIdent bool
+
+	identSet bool
+	url      *url.URL
+	dialer   proxy.Dialer
+}
+
+// Option configures a Dialer constructed by NewDialer.
+type Option func(*Dialer)
+
+// WithIdent overrides the USERID sent in every request, taking precedence
+// over the dial URL's userinfo. WithIdent("") sends a genuinely empty
+// USERID rather than falling back to the package-level Ident.
+func WithIdent(ident string) Option {
+	return func(d *Dialer) {
+		d.Ident = ident
+		d.identSet = true
+	}
+}
+
+// WithResolver overrides the resolver used to look up socks4 (non-4a)
+// destination hosts.
+func WithResolver(r *net.Resolver) Option {
+	return func(d *Dialer) { d.Resolver = r }
+}
+
+// WithTimeout bounds the SOCKS4 handshake of Dial and DialContext.
+func WithTimeout(timeout time.Duration) Option {
+	return func(d *Dialer) { d.Timeout = timeout }
+}
+
+// WithKeepGlobalIdent restores the pre-NewDialer behavior of always sending
+// the package-level Ident var, ignoring both the per-instance Ident and the
+// dial URL's userinfo.
+func WithKeepGlobalIdent() Option {
+	return func(d *Dialer) { d.KeepGlobalIdent = true }
+}
+
+// NewDialer builds a Dialer that talks SOCKS4 or SOCKS4a (depending on
+// u.Scheme) to the proxy at u.Host, forwarding the initial connection
+// through forward (proxy.Direct if nil).
+//
+// When u carries userinfo, e.g. "socks4://user@host:port", its username is
+// used as the per-instance USERID, following the pattern obfs4proxy uses to
+// repurpose that field for per-bridge arguments. This lets a single binary
+// dial through multiple SOCKS4 proxies with different idents, which the
+// package-level Ident variable alone cannot do.
+func NewDialer(u *url.URL, forward proxy.Dialer, opts ...Option) (proxy.Dialer, error) {
+	if forward == nil {
+		forward = proxy.Direct
+	}
+
+	d := &Dialer{
+		url:    u,
+		dialer: forward,
+	}
+
+	if u != nil && u.User != nil {
+		if user := u.User.Username(); user != "" {
+			d.Ident = user
+			d.identSet = true
+		}
+	}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	return d, nil
 }
 
 // Dial implements proxy.Dialer interface
-func (s socks4) Dial(network, addr string) (c net.Conn, err error) {
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext implements proxy.ContextDialer: it performs the SOCKS4/4a
+// handshake, honoring ctx (and Timeout, if set) for both the DNS lookup of
+// socks4 (non-4a) hosts and the handshake itself, closing the connection if
+// ctx is canceled before the handshake completes.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (c net.Conn, err error) {
 	if network != "tcp" && network != "tcp4" {
 		return nil, ErrWrongNetwork
 	}
 
-	c, err = s.dialer.Dial(network, s.url.Host)
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	c, err = dialContext(ctx, d.dialer, network, d.url.Host)
 	if err != nil {
 		return nil, ErrDialFailed.Wrap(err)
 	}
@@ -73,7 +179,34 @@ func (s socks4) Dial(network, addr string) (c net.Conn, err error) {
 		}
 	}()
 
-	req, err := s.prepareRequest(addr)
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = c.SetDeadline(deadline); err != nil {
+			return c, ErrIO.Wrap(err)
+		}
+	}
+
+	// Close the connection if ctx is canceled mid-handshake; done stops the
+	// watcher once the handshake (successfully or not) is over, and the
+	// deferred wait makes sure it has stopped before DialContext returns.
+	done := make(chan struct{})
+	watchErr := make(chan error, 1)
+	defer func() {
+		close(done)
+		if ctxErr := <-watchErr; ctxErr != nil && err == nil {
+			err = ErrIO.Wrap(ctxErr)
+		}
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = c.Close()
+			watchErr <- ctx.Err()
+		case <-done:
+			watchErr <- nil
+		}
+	}()
+
+	req, err := d.prepareRequest(ctx, addr)
 	if err != nil {
 		return c, err
 	}
@@ -81,7 +214,7 @@ func (s socks4) Dial(network, addr string) (c net.Conn, err error) {
 	var i int
 	i, err = c.Write(req)
 	if err != nil {
-		return c, ErrIO.Wrap(err)
+		return c, wrapCtxErr(ctx, err)
 	} else if i < minRequestLen {
 		return c, ErrIO.Wrap(io.ErrShortWrite)
 	}
@@ -89,11 +222,15 @@ func (s socks4) Dial(network, addr string) (c net.Conn, err error) {
 	var resp [8]byte
 	i, err = c.Read(resp[:])
 	if err != nil && err != io.EOF {
-		return c, ErrIO.Wrap(err)
+		return c, wrapCtxErr(ctx, err)
 	} else if i != 8 {
 		return c, ErrIO.Wrap(io.ErrUnexpectedEOF)
 	}
 
+	if err = c.SetDeadline(time.Time{}); err != nil {
+		return c, ErrIO.Wrap(err)
+	}
+
 	switch resp[1] {
 	case accessGranted:
 		return c, nil
@@ -106,22 +243,86 @@ func (s socks4) Dial(network, addr string) (c net.Conn, err error) {
 	}
 }
 
-func (s socks4) lookupAddr(host string) (net.IP, error) {
-	ip, err := net.ResolveIPAddr("ip4", host)
+// dialContext dials through dialer honoring ctx even when dialer doesn't
+// implement proxy.ContextDialer, so a slow or hanging forward dialer can't
+// make ctx cancellation useless to DialContext's caller.
+func dialContext(ctx context.Context, dialer proxy.Dialer, network, addr string) (net.Conn, error) {
+	if cd, ok := dialer.(proxy.ContextDialer); ok {
+		return cd.DialContext(ctx, network, addr)
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		conn, err := dialer.Dial(network, addr)
+		done <- result{conn, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				_ = r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// wrapCtxErr prefers ctx's error over err when ctx is the reason the
+// connection was closed mid-handshake.
+func wrapCtxErr(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ErrIO.Wrap(ctxErr)
+	}
+
+	return ErrIO.Wrap(err)
+}
+
+// ident returns the USERID this Dialer should send. If neither NewDialer's
+// userinfo nor WithIdent set an explicit value (including ""), it keeps
+// reading the live package-level Ident var, honoring KeepGlobalIdent either
+// way.
+func (d *Dialer) ident() string {
+	if d.KeepGlobalIdent || !d.identSet {
+		return Ident
+	}
+
+	return d.Ident
+}
+
+func (d *Dialer) resolver() *net.Resolver {
+	if d.Resolver != nil {
+		return d.Resolver
+	}
+
+	return net.DefaultResolver
+}
+
+func (d *Dialer) lookupAddr(ctx context.Context, host string) (net.IP, error) {
+	ips, err := d.resolver().LookupIP(ctx, "ip4", host)
 	if err != nil {
 		return net.IP{}, ErrHostUnknown.WithArgs(host).Wrap(err)
+	} else if len(ips) == 0 {
+		return net.IP{}, ErrHostUnknown.WithArgs(host)
 	}
 
-	return ip.IP.To4(), err
+	return ips[0].To4(), nil
 }
 
-func (s socks4) prepareRequest(addr string) ([]byte, error) {
+func (d *Dialer) prepareRequest(ctx context.Context, addr string) ([]byte, error) {
 	var (
 		buf bytes.Buffer
 		err error
 	)
 
-	host, port, err := s.parseAddr(addr)
+	host, port, err := d.parseAddr(addr)
 
 	buf.Write([]byte{socksVersion, socksConnect})
 	_ = binary.Write(&buf, binary.BigEndian, uint16(port))
@@ -129,19 +330,19 @@ func (s socks4) prepareRequest(addr string) ([]byte, error) {
 	// socks4a defines IP as 0.0.0.x
 	var ip = net.IPv4(0, 0, 0, 1)
 
-	if !s.isSocks4a() {
-		ip, err = s.lookupAddr(host)
+	if !d.isSocks4a() {
+		ip, err = d.lookupAddr(ctx, host)
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	_ = binary.Write(&buf, binary.BigEndian, ip.To4())
-	buf.WriteString(Ident)
+	buf.WriteString(d.ident())
 
 	buf.WriteByte(0)
 
-	if s.isSocks4a() {
+	if d.isSocks4a() {
 		buf.WriteString(host)
 		buf.WriteByte(0)
 	}
@@ -149,11 +350,11 @@ func (s socks4) prepareRequest(addr string) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func (s socks4) isSocks4a() bool {
-	return s.url.Scheme == "socks4a"
+func (d *Dialer) isSocks4a() bool {
+	return d.url.Scheme == "socks4a"
 }
 
-func (s socks4) parseAddr(addr string) (host string, iport int, err error) {
+func (d *Dialer) parseAddr(addr string) (host string, iport int, err error) {
 	var port string
 	host, port, err = net.SplitHostPort(addr)
 	if err != nil {
@@ -167,3 +368,123 @@ func (s socks4) parseAddr(addr string) (host string, iport int, err error) {
 
 	return
 }
+
+// Listen issues a SOCKS4 BIND request for addr, the host and port the proxy
+// should expect the remote peer to connect back from (use "0.0.0.0:0" when
+// that is not known in advance). The returned Listener's Addr is the
+// proxy-assigned bind address to hand to that remote peer; Accept blocks on
+// the proxy's second reply, which arrives once the peer connects. This is
+// what classic active-mode FTP needs from a SOCKS4 proxy.
+func (d *Dialer) Listen(network, addr string) (net.Listener, error) {
+	if network != "tcp" && network != "tcp4" {
+		return nil, ErrWrongNetwork
+	}
+
+	c, err := d.dialer.Dial(network, d.url.Host)
+	if err != nil {
+		return nil, ErrDialFailed.Wrap(err)
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			_ = c.Close()
+		}
+	}()
+
+	req, err := d.prepareBindRequest(context.Background(), addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var i int
+	i, err = c.Write(req)
+	if err != nil {
+		return nil, ErrIO.Wrap(err)
+	} else if i < minRequestLen {
+		return nil, ErrIO.Wrap(io.ErrShortWrite)
+	}
+
+	var resp [8]byte
+	i, err = c.Read(resp[:])
+	if err != nil && err != io.EOF {
+		return nil, ErrIO.Wrap(err)
+	} else if i != 8 {
+		return nil, ErrIO.Wrap(io.ErrUnexpectedEOF)
+	}
+
+	switch resp[1] {
+	case accessGranted:
+		ok = true
+		return &bindListener{
+			conn: c,
+			addr: &net.TCPAddr{
+				IP:   net.IP(resp[4:8]),
+				Port: int(binary.BigEndian.Uint16(resp[2:4])),
+			},
+		}, nil
+	case accessIdentRequired, accessIdentFailed:
+		return nil, ErrIdentRequired
+	case accessRejected:
+		return nil, ErrConnRejected
+	default:
+		return nil, ErrInvalidResponse.WithArgs(resp[1])
+	}
+}
+
+func (d *Dialer) prepareBindRequest(ctx context.Context, addr string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	host, port, err := d.parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ip, err := d.lookupAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	buf.Write([]byte{socksVersion, socksBind})
+	_ = binary.Write(&buf, binary.BigEndian, uint16(port))
+	_ = binary.Write(&buf, binary.BigEndian, ip.To4())
+	buf.WriteString(d.ident())
+	buf.WriteByte(0)
+
+	return buf.Bytes(), nil
+}
+
+// bindListener is the net.Listener returned by Dialer.Listen. It wraps the
+// single connection the BIND handshake was made on: Accept blocks for the
+// proxy's second reply instead of accepting new TCP connections itself,
+// since a SOCKS4 proxy only ever connects the one remote peer it was told
+// to expect.
+type bindListener struct {
+	conn net.Conn
+	addr net.Addr
+}
+
+// Accept blocks until the proxy's second BIND reply arrives, reporting the
+// remote peer's connection.
+func (l *bindListener) Accept() (net.Conn, error) {
+	var resp [8]byte
+	i, err := l.conn.Read(resp[:])
+	if err != nil && err != io.EOF {
+		return nil, ErrIO.Wrap(err)
+	} else if i != 8 {
+		return nil, ErrIO.Wrap(io.ErrUnexpectedEOF)
+	}
+
+	switch resp[1] {
+	case accessGranted:
+		return l.conn, nil
+	case accessIdentRequired, accessIdentFailed:
+		return nil, ErrIdentRequired
+	case accessRejected:
+		return nil, ErrConnRejected
+	default:
+		return nil, ErrInvalidResponse.WithArgs(resp[1])
+	}
+}
+
+func (l *bindListener) Close() error   { return l.conn.Close() }
+func (l *bindListener) Addr() net.Addr { return l.addr }
@@ -0,0 +1,114 @@
+package socks4
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// TestIdentPrecedence exercises the USERID precedence rules from NewDialer:
+// a live package-level Ident by default, a dial URL's userinfo when present,
+// and KeepGlobalIdent overriding both back to the live global.
+func TestIdentPrecedence(t *testing.T) {
+	defer func(orig string) { Ident = orig }(Ident)
+
+	Ident = "global@0.0.0.0"
+
+	d, err := NewDialer(&url.URL{Scheme: "socks4", Host: "proxy:1080"}, nil)
+	if err != nil {
+		t.Fatalf("NewDialer: %v", err)
+	}
+	noUserinfo := d.(*Dialer)
+
+	if got := noUserinfo.ident(); got != "global@0.0.0.0" {
+		t.Fatalf("ident() = %q, want live global %q", got, "global@0.0.0.0")
+	}
+
+	Ident = "updated@0.0.0.0"
+	if got := noUserinfo.ident(); got != "updated@0.0.0.0" {
+		t.Fatalf("ident() = %q, want to keep tracking the live global after it changes", got)
+	}
+
+	u := &url.URL{Scheme: "socks4", Host: "proxy:1080", User: url.User("alice")}
+
+	d2, err := NewDialer(u, nil)
+	if err != nil {
+		t.Fatalf("NewDialer: %v", err)
+	}
+	withUserinfo := d2.(*Dialer)
+
+	if got := withUserinfo.ident(); got != "alice" {
+		t.Fatalf("ident() = %q, want userinfo override %q", got, "alice")
+	}
+
+	Ident = "updated-again@0.0.0.0"
+	if got := withUserinfo.ident(); got != "alice" {
+		t.Fatalf("ident() = %q, want userinfo override to stay put despite global change", got)
+	}
+
+	d3, err := NewDialer(u, nil, WithKeepGlobalIdent())
+	if err != nil {
+		t.Fatalf("NewDialer: %v", err)
+	}
+	keepGlobal := d3.(*Dialer)
+
+	if got := keepGlobal.ident(); got != Ident {
+		t.Fatalf("ident() = %q, want live global %q with KeepGlobalIdent set", got, Ident)
+	}
+
+	d4, err := NewDialer(&url.URL{Scheme: "socks4", Host: "proxy:1080"}, nil, WithIdent(""))
+	if err != nil {
+		t.Fatalf("NewDialer: %v", err)
+	}
+	explicitEmpty := d4.(*Dialer)
+
+	if got := explicitEmpty.ident(); got != "" {
+		t.Fatalf("ident() = %q, want explicit empty ident from WithIdent(\"\") rather than falling back to the global", got)
+	}
+}
+
+// slowDialer simulates a forward dialer that hangs well past the caller's
+// deadline, so that DialContext's own timeout is the only thing that can
+// return control to the caller on time.
+type slowDialer struct {
+	delay time.Duration
+}
+
+func (s slowDialer) Dial(network, addr string) (net.Conn, error) {
+	time.Sleep(s.delay)
+	return nil, errors.New("slowDialer: forward dial should have been abandoned")
+}
+
+// TestDialContextCancellation verifies that DialContext bounds the forward
+// dial itself, not just the handshake that follows it, even when the
+// forward dialer doesn't implement proxy.ContextDialer.
+func TestDialContextCancellation(t *testing.T) {
+	d, err := NewDialer(&url.URL{Scheme: "socks4", Host: "proxy:1080"}, slowDialer{delay: 3 * time.Second})
+	if err != nil {
+		t.Fatalf("NewDialer: %v", err)
+	}
+
+	cd, ok := d.(proxy.ContextDialer)
+	if !ok {
+		t.Fatalf("%T does not implement proxy.ContextDialer", d)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = cd.DialContext(ctx, "tcp", "example.com:80")
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatal("DialContext succeeded against a forward dialer that should have been abandoned")
+	}
+	if elapsed > time.Second {
+		t.Fatalf("DialContext blocked for %v, want it to return around its 200ms ctx timeout", elapsed)
+	}
+}